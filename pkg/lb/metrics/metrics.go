@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics exposes the per-pod data pkg/util/lb.ComputePodStatus
+// assembles as Prometheus series, so operators can alert on LB pods stuck
+// in CrashLoopBackOff, NodeLost, or Terminating without shelling into the
+// cluster.
+//
+// TODO: this repo has no cmd/ controller binary yet to call
+// ObservePodStatuses/ObserveReplicasDesired/DeleteLoadBalancer from, or to
+// serve /metrics. Wiring it into the reconcile loop is tracked as a
+// follow-up, not dropped.
+package metrics
+
+import (
+	"sync"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// podReady is 1 when a pod's PodStatus.Ready is true, 0 otherwise; a
+	// terminating or still-initializing pod reads 0 even with all of its
+	// containers ready.
+	podReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loadbalancer_pod_ready",
+		Help: "Whether an LB backing pod is fully ready (1) or not (0).",
+	}, []string{"namespace", "loadbalancer", "pod"})
+
+	// podRestarts tracks cumulative container restarts per pod. It is a
+	// gauge, not a counter, because the value is read off PodStatus rather
+	// than accumulated by us, so it must not carry the "_total" suffix
+	// promlint reserves for counters.
+	podRestarts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loadbalancer_pod_restarts",
+		Help: "Cumulative container restarts observed for an LB backing pod.",
+	}, []string{"namespace", "loadbalancer", "pod"})
+
+	// podReason is 1 for the pod's current status reason and 0 for every
+	// other reason previously reported for that pod, so a PromQL query can
+	// alert on e.g. loadbalancer_pod_reason{reason="CrashLoopBackOff"} == 1.
+	podReason = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loadbalancer_pod_reason",
+		Help: "1 for an LB backing pod's current status reason, 0 otherwise.",
+	}, []string{"namespace", "loadbalancer", "pod", "reason"})
+
+	// replicasDesired mirrors pkg/util/lb.CalculateReplicas' result.
+	replicasDesired = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loadbalancer_replicas_desired",
+		Help: "Desired replica count for a LoadBalancer, as computed by CalculateReplicas.",
+	}, []string{"namespace", "loadbalancer"})
+)
+
+func init() {
+	prometheus.MustRegister(podReady, podRestarts, podReason, replicasDesired)
+}
+
+// seenReasons remembers, per pod, which reason labels have been set so they
+// can be zeroed out once the pod's reason changes; otherwise stale reasons
+// would linger at 1 forever. seenReasonsMu guards it, and lbPods alongside
+// it, because reconcile loops run with multiple concurrent workers.
+var (
+	seenReasonsMu sync.Mutex
+	seenReasons   = map[string]map[string]struct{}{}
+	// lbPods tracks, per LoadBalancer, which pod names currently have series
+	// registered, so ObservePodStatuses can prune a pod that disappeared
+	// between reconciles instead of leaking its series forever.
+	lbPods = map[string]map[string]struct{}{}
+)
+
+// ObservePodStatuses updates podReady, podRestarts and podReason for every
+// status in statuses, which belong to the named LoadBalancer, and deletes
+// the series for any previously-observed pod of that LoadBalancer that's
+// no longer in statuses.
+func ObservePodStatuses(namespace, loadbalancer string, statuses []lbapi.PodStatus) {
+	seenReasonsMu.Lock()
+	defer seenReasonsMu.Unlock()
+
+	lbKey := namespace + "/" + loadbalancer
+	live := make(map[string]struct{}, len(statuses))
+
+	for _, status := range statuses {
+		live[status.Name] = struct{}{}
+
+		ready := 0.0
+		if status.Ready {
+			ready = 1.0
+		}
+		podReady.WithLabelValues(namespace, loadbalancer, status.Name).Set(ready)
+		podRestarts.WithLabelValues(namespace, loadbalancer, status.Name).Set(float64(status.RestartCount))
+
+		key := namespace + "/" + loadbalancer + "/" + status.Name
+		for reason := range seenReasons[key] {
+			if reason != status.Reason {
+				podReason.WithLabelValues(namespace, loadbalancer, status.Name, reason).Set(0)
+			}
+		}
+		podReason.WithLabelValues(namespace, loadbalancer, status.Name, status.Reason).Set(1)
+
+		if seenReasons[key] == nil {
+			seenReasons[key] = map[string]struct{}{}
+		}
+		seenReasons[key][status.Reason] = struct{}{}
+	}
+
+	for name := range lbPods[lbKey] {
+		if _, ok := live[name]; !ok {
+			deletePodLocked(namespace, loadbalancer, name)
+		}
+	}
+	lbPods[lbKey] = live
+}
+
+// ObserveReplicasDesired updates replicasDesired for the named LoadBalancer.
+func ObserveReplicasDesired(namespace, loadbalancer string, desired int32) {
+	replicasDesired.WithLabelValues(namespace, loadbalancer).Set(float64(desired))
+}
+
+// DeleteLoadBalancer removes every series ObservePodStatuses and
+// ObserveReplicasDesired registered for loadbalancer. Call it when a
+// reconcile loop observes the LoadBalancer itself was deleted, since
+// nothing else prunes its series once ObservePodStatuses stops being called
+// for it.
+func DeleteLoadBalancer(namespace, loadbalancer string) {
+	seenReasonsMu.Lock()
+	defer seenReasonsMu.Unlock()
+
+	lbKey := namespace + "/" + loadbalancer
+	for name := range lbPods[lbKey] {
+		deletePodLocked(namespace, loadbalancer, name)
+	}
+	delete(lbPods, lbKey)
+	replicasDesired.DeleteLabelValues(namespace, loadbalancer)
+}
+
+// deletePodLocked removes pod's podReady/podRestarts/podReason series and
+// its seenReasons entry. Callers must hold seenReasonsMu.
+func deletePodLocked(namespace, loadbalancer, pod string) {
+	podReady.DeleteLabelValues(namespace, loadbalancer, pod)
+	podRestarts.DeleteLabelValues(namespace, loadbalancer, pod)
+
+	key := namespace + "/" + loadbalancer + "/" + pod
+	for reason := range seenReasons[key] {
+		podReason.DeleteLabelValues(namespace, loadbalancer, pod, reason)
+	}
+	delete(seenReasons, key)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObservePodStatuses(t *testing.T) {
+	ObservePodStatuses("kube-system", "lb-test", []lbapi.PodStatus{
+		{Name: "lb-test-proxy-0", Ready: true, RestartCount: 2, Reason: "Running"},
+		{Name: "lb-test-proxy-1", Ready: false, RestartCount: 7, Reason: "CrashLoopBackOff"},
+	})
+
+	if got := testutil.ToFloat64(podReady.WithLabelValues("kube-system", "lb-test", "lb-test-proxy-0")); got != 1 {
+		t.Errorf("podReady for proxy-0 = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(podReady.WithLabelValues("kube-system", "lb-test", "lb-test-proxy-1")); got != 0 {
+		t.Errorf("podReady for proxy-1 = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(podRestarts.WithLabelValues("kube-system", "lb-test", "lb-test-proxy-1")); got != 7 {
+		t.Errorf("podRestarts for proxy-1 = %v, want 7", got)
+	}
+	if got := testutil.ToFloat64(podReason.WithLabelValues("kube-system", "lb-test", "lb-test-proxy-1", "CrashLoopBackOff")); got != 1 {
+		t.Errorf("podReason CrashLoopBackOff for proxy-1 = %v, want 1", got)
+	}
+
+	// proxy-1 recovers: its old reason must be zeroed out, not just
+	// superseded, so a stale CrashLoopBackOff==1 series doesn't linger.
+	ObservePodStatuses("kube-system", "lb-test", []lbapi.PodStatus{
+		{Name: "lb-test-proxy-1", Ready: true, RestartCount: 7, Reason: "Running"},
+	})
+
+	if got := testutil.ToFloat64(podReason.WithLabelValues("kube-system", "lb-test", "lb-test-proxy-1", "CrashLoopBackOff")); got != 0 {
+		t.Errorf("podReason CrashLoopBackOff for proxy-1 after recovery = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(podReason.WithLabelValues("kube-system", "lb-test", "lb-test-proxy-1", "Running")); got != 1 {
+		t.Errorf("podReason Running for proxy-1 after recovery = %v, want 1", got)
+	}
+}
+
+func TestObserveReplicasDesired(t *testing.T) {
+	ObserveReplicasDesired("kube-system", "lb-test", 3)
+
+	if got := testutil.ToFloat64(replicasDesired.WithLabelValues("kube-system", "lb-test")); got != 3 {
+		t.Errorf("replicasDesired = %v, want 3", got)
+	}
+}
+
+// TestObservePodStatusesPrunesGoneStatusPods guards against the gauge and
+// seenReasons leak: a pod missing from a later ObservePodStatuses call must
+// have its series deleted, not just left stale.
+func TestObservePodStatusesPrunesGoneStatusPods(t *testing.T) {
+	ObservePodStatuses("kube-system", "lb-prune", []lbapi.PodStatus{
+		{Name: "lb-prune-proxy-0", Ready: true, RestartCount: 1, Reason: "Running"},
+	})
+	if got := testutil.ToFloat64(podReady.WithLabelValues("kube-system", "lb-prune", "lb-prune-proxy-0")); got != 1 {
+		t.Fatalf("podReady before prune = %v, want 1", got)
+	}
+
+	ObservePodStatuses("kube-system", "lb-prune", nil)
+
+	if got := testutil.ToFloat64(podReady.WithLabelValues("kube-system", "lb-prune", "lb-prune-proxy-0")); got != 0 {
+		t.Errorf("podReady after prune = %v, want 0 (deleted series reads back as a fresh 0)", got)
+	}
+	if got := testutil.ToFloat64(podReason.WithLabelValues("kube-system", "lb-prune", "lb-prune-proxy-0", "Running")); got != 0 {
+		t.Errorf("podReason Running after prune = %v, want 0", got)
+	}
+	if _, ok := seenReasons["kube-system/lb-prune/lb-prune-proxy-0"]; ok {
+		t.Errorf("seenReasons entry for pruned pod was not deleted")
+	}
+}
+
+// TestDeleteLoadBalancer guards against a deleted LoadBalancer's series
+// lingering forever, since nothing else calls ObservePodStatuses for it
+// again once it's gone.
+func TestDeleteLoadBalancer(t *testing.T) {
+	ObservePodStatuses("kube-system", "lb-deleted", []lbapi.PodStatus{
+		{Name: "lb-deleted-proxy-0", Ready: true, RestartCount: 1, Reason: "Running"},
+	})
+	ObserveReplicasDesired("kube-system", "lb-deleted", 1)
+
+	DeleteLoadBalancer("kube-system", "lb-deleted")
+
+	if got := testutil.ToFloat64(podReady.WithLabelValues("kube-system", "lb-deleted", "lb-deleted-proxy-0")); got != 0 {
+		t.Errorf("podReady after DeleteLoadBalancer = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(replicasDesired.WithLabelValues("kube-system", "lb-deleted")); got != 0 {
+		t.Errorf("replicasDesired after DeleteLoadBalancer = %v, want 0", got)
+	}
+	if _, ok := lbPods["kube-system/lb-deleted"]; ok {
+		t.Errorf("lbPods entry for deleted LoadBalancer was not deleted")
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package restartguard self-heals LB backing pods (nginx/haproxy/ipvsdr
+// proxies and providers) that are wedged in a restart loop on a bad node.
+// It reads the per-pod restart counts that pkg/util/lb.ComputePodStatus
+// already gathers and, once a pod crosses a configurable threshold, evicts
+// it so the scheduler can try another node instead of the LB replica
+// staying pinned forever.
+//
+// TODO: this repo has no cmd/ controller binary or reconcile loop yet to
+// call Guard.CheckAndEvict from. Wiring it in is tracked as a follow-up;
+// until then, pods over the restart threshold are not actually evicted.
+package restartguard
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	lbutil "github.com/caicloud/loadbalancer-controller/pkg/util/lb"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	policyv1beta1 "k8s.io/client-go/pkg/apis/policy/v1beta1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// MaxPodRestartsAnnotation overrides, per LoadBalancer, the
+	// controller-wide default restart threshold above which a backing pod
+	// is evicted.
+	MaxPodRestartsAnnotation = "loadbalance.caicloud.io/max-pod-restarts"
+
+	// IncludeInitRestartsAnnotation opts a LoadBalancer into counting
+	// restarts accumulated by non-restartable init containers towards the
+	// threshold, in addition to regular (and sidecar) container restarts.
+	IncludeInitRestartsAnnotation = "loadbalance.caicloud.io/include-init-container-restarts"
+
+	// eventReason is used for the Event recorded on the LoadBalancer when a
+	// pod is evicted for too many restarts.
+	eventReason = "TooManyRestarts"
+)
+
+// defaultMaxPodRestartsFlag is the controller-wide default restart
+// threshold, used for any LoadBalancer that doesn't set
+// MaxPodRestartsAnnotation. It is registered on the default flag set, so a
+// command-line value takes effect only once the program calls flag.Parse.
+var defaultMaxPodRestartsFlag = flag.Int("lb-max-pod-restarts", 20,
+	"Default number of container restarts an LB backing pod may accumulate before restartguard evicts it; "+
+		"overridden per-LoadBalancer via the "+MaxPodRestartsAnnotation+" annotation.")
+
+// Guard evicts LB backing pods that have restarted more than a configurable
+// number of times, mirroring the descheduler's RemovePodsHavingTooManyRestarts
+// policy. CheckAndEvict takes the PodStatuses computed for a LoadBalancer.
+type Guard struct {
+	client kubernetes.Interface
+	// recorder emits the TooManyRestarts Event onto the owning LoadBalancer.
+	recorder record.EventRecorder
+	// DefaultMaxPodRestarts is used when a LoadBalancer does not carry the
+	// MaxPodRestartsAnnotation. Set from a controller-wide flag.
+	DefaultMaxPodRestarts int32
+}
+
+// NewGuard creates a Guard with an explicit default threshold.
+func NewGuard(client kubernetes.Interface, recorder record.EventRecorder, defaultMaxPodRestarts int32) *Guard {
+	return &Guard{
+		client:                client,
+		recorder:              recorder,
+		DefaultMaxPodRestarts: defaultMaxPodRestarts,
+	}
+}
+
+// NewGuardFromFlags creates a Guard using the controller-wide
+// -lb-max-pod-restarts default flag.
+func NewGuardFromFlags(client kubernetes.Interface, recorder record.EventRecorder) *Guard {
+	return NewGuard(client, recorder, int32(*defaultMaxPodRestartsFlag))
+}
+
+// maxRestarts returns the restart threshold for lb, honouring the
+// per-LoadBalancer annotation override.
+func (g *Guard) maxRestarts(lb *lbapi.LoadBalancer) int32 {
+	v, ok := lb.Annotations[MaxPodRestartsAnnotation]
+	if !ok {
+		return g.DefaultMaxPodRestarts
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return g.DefaultMaxPodRestarts
+	}
+	return int32(n)
+}
+
+// includeInitRestarts reports whether lb opted in to counting init
+// container restarts towards the threshold.
+func includeInitRestarts(lb *lbapi.LoadBalancer) bool {
+	v, ok := lb.Annotations[IncludeInitRestartsAnnotation]
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
+
+// restartsOf returns the restart count to compare against the threshold for
+// status, depending on whether lb opted in to counting init restarts.
+func restartsOf(lb *lbapi.LoadBalancer, status lbapi.PodStatus) int32 {
+	if includeInitRestarts(lb) {
+		return status.TotalRestarts
+	}
+	return status.RestartCount
+}
+
+// CheckAndEvict walks statuses and evicts every pod whose restart count
+// exceeds lb's threshold. A threshold of zero or less evicts nothing. It
+// returns the first eviction error encountered, after attempting the
+// remaining pods.
+func (g *Guard) CheckAndEvict(lb *lbapi.LoadBalancer, namespace string, statuses []lbapi.PodStatus) error {
+	threshold := g.maxRestarts(lb)
+	if threshold <= 0 {
+		return nil
+	}
+
+	var firstErr error
+	for _, status := range statuses {
+		if restartsOf(lb, status) <= threshold {
+			continue
+		}
+		if err := g.evict(lb, namespace, status); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// evict evicts a single pod, retrying with the shared lbutil.DefaultRetry
+// backoff while a PodDisruptionBudget blocks it (TooManyRequests), and
+// records why on lb. Any other error is returned without a retry.
+func (g *Guard) evict(lb *lbapi.LoadBalancer, namespace string, status lbapi.PodStatus) error {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      status.Name,
+			Namespace: namespace,
+		},
+	}
+
+	err := wait.ExponentialBackoff(lbutil.DefaultRetry, func() (bool, error) {
+		err := g.client.PolicyV1beta1().Evictions(namespace).Evict(eviction)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.IsTooManyRequests(err):
+			// a PodDisruptionBudget is blocking the eviction for now, back off and retry
+			return false, nil
+		case errors.IsNotFound(err):
+			// already gone, nothing left to do
+			return true, nil
+		default:
+			return false, err
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("evict pod %s/%s: %v", namespace, status.Name, err)
+	}
+
+	g.recorder.Eventf(lb, "Normal", eventReason,
+		"Evicted pod %s after %d restarts (threshold %d)", status.Name, restartsOf(lb, status), g.maxRestarts(lb))
+	return nil
+}
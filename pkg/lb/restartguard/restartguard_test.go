@@ -0,0 +1,307 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restartguard
+
+import (
+	"fmt"
+	"testing"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	lbutil "github.com/caicloud/loadbalancer-controller/pkg/util/lb"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func newLoadBalancer(annotations map[string]string) *lbapi.LoadBalancer {
+	return &lbapi.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "lb-test",
+			Namespace:   "kube-system",
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestGuardMaxRestarts(t *testing.T) {
+	tests := []struct {
+		name string
+		lb   *lbapi.LoadBalancer
+		want int32
+	}{
+		{
+			name: "no annotation falls back to the controller-wide default",
+			lb:   newLoadBalancer(nil),
+			want: 20,
+		},
+		{
+			name: "annotation overrides the default",
+			lb:   newLoadBalancer(map[string]string{MaxPodRestartsAnnotation: "5"}),
+			want: 5,
+		},
+		{
+			name: "invalid annotation value falls back to the default",
+			lb:   newLoadBalancer(map[string]string{MaxPodRestartsAnnotation: "not-a-number"}),
+			want: 20,
+		},
+	}
+
+	g := NewGuard(fake.NewSimpleClientset(), record.NewFakeRecorder(10), 20)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.maxRestarts(tt.lb); got != tt.want {
+				t.Errorf("maxRestarts() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludeInitRestarts(t *testing.T) {
+	tests := []struct {
+		name string
+		lb   *lbapi.LoadBalancer
+		want bool
+	}{
+		{
+			name: "no annotation defaults to excluding init restarts",
+			lb:   newLoadBalancer(nil),
+			want: false,
+		},
+		{
+			name: "annotation set to true opts in",
+			lb:   newLoadBalancer(map[string]string{IncludeInitRestartsAnnotation: "true"}),
+			want: true,
+		},
+		{
+			name: "invalid annotation value defaults to excluding init restarts",
+			lb:   newLoadBalancer(map[string]string{IncludeInitRestartsAnnotation: "not-a-bool"}),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := includeInitRestarts(tt.lb); got != tt.want {
+				t.Errorf("includeInitRestarts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartsOf(t *testing.T) {
+	status := lbapi.PodStatus{Name: "lb-test-proxy-0", RestartCount: 3, TotalRestarts: 9}
+
+	tests := []struct {
+		name string
+		lb   *lbapi.LoadBalancer
+		want int32
+	}{
+		{
+			name: "init restarts excluded by default",
+			lb:   newLoadBalancer(nil),
+			want: 3,
+		},
+		{
+			name: "init restarts included when opted in",
+			lb:   newLoadBalancer(map[string]string{IncludeInitRestartsAnnotation: "true"}),
+			want: 9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restartsOf(tt.lb, status); got != tt.want {
+				t.Errorf("restartsOf() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAndEvict(t *testing.T) {
+	t.Run("pod under threshold is left alone", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		g := NewGuard(client, record.NewFakeRecorder(10), 20)
+		lb := newLoadBalancer(nil)
+
+		if err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 5},
+		}); err != nil {
+			t.Fatalf("CheckAndEvict() error = %v", err)
+		}
+
+		for _, action := range client.Actions() {
+			if action.Matches("create", "pods") && action.GetSubresource() == "eviction" {
+				t.Fatalf("unexpected eviction action: %+v", action)
+			}
+		}
+	})
+
+	t.Run("pod over threshold is evicted and recorded", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		recorder := record.NewFakeRecorder(10)
+		g := NewGuard(client, recorder, 5)
+		lb := newLoadBalancer(nil)
+
+		if err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 6},
+		}); err != nil {
+			t.Fatalf("CheckAndEvict() error = %v", err)
+		}
+
+		evicted := false
+		for _, action := range client.Actions() {
+			if action.Matches("create", "pods") && action.GetSubresource() == "eviction" {
+				evicted = true
+			}
+		}
+		if !evicted {
+			t.Fatalf("expected an eviction action, got none")
+		}
+
+		select {
+		case event := <-recorder.Events:
+			if event == "" {
+				t.Fatalf("got empty event")
+			}
+		default:
+			t.Fatalf("expected a TooManyRestarts event to be recorded")
+		}
+	})
+
+	t.Run("threshold comparison is strictly greater than", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		g := NewGuard(client, record.NewFakeRecorder(10), 5)
+		lb := newLoadBalancer(nil)
+
+		if err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 5},
+		}); err != nil {
+			t.Fatalf("CheckAndEvict() error = %v", err)
+		}
+
+		for _, action := range client.Actions() {
+			if action.Matches("create", "pods") && action.GetSubresource() == "eviction" {
+				t.Fatalf("restart count equal to threshold must not evict, got action: %+v", action)
+			}
+		}
+	})
+
+	t.Run("init restarts only counted when opted in", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		g := NewGuard(client, record.NewFakeRecorder(10), 5)
+		lb := newLoadBalancer(map[string]string{IncludeInitRestartsAnnotation: "true"})
+
+		if err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 2, TotalRestarts: 6},
+		}); err != nil {
+			t.Fatalf("CheckAndEvict() error = %v", err)
+		}
+
+		evicted := false
+		for _, action := range client.Actions() {
+			if action.Matches("create", "pods") && action.GetSubresource() == "eviction" {
+				evicted = true
+			}
+		}
+		if !evicted {
+			t.Fatalf("expected eviction based on TotalRestarts, got none")
+		}
+	})
+
+	t.Run("PDB-blocked eviction retries then gives up", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		calls := 0
+		client.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "eviction" {
+				return false, nil, nil
+			}
+			calls++
+			return true, nil, kerrors.NewTooManyRequests("pdb blocks eviction", 0)
+		})
+		g := NewGuard(client, record.NewFakeRecorder(10), 5)
+		lb := newLoadBalancer(nil)
+
+		err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 10},
+		})
+		if err == nil {
+			t.Fatalf("CheckAndEvict() error = nil, want an error after exhausting retries")
+		}
+		if calls != lbutil.DefaultRetry.Steps {
+			t.Fatalf("got %d eviction attempts, want %d (lbutil.DefaultRetry.Steps)", calls, lbutil.DefaultRetry.Steps)
+		}
+	})
+
+	t.Run("eviction of an already-gone pod is not an error", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		client.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "eviction" {
+				return false, nil, nil
+			}
+			return true, nil, kerrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "lb-test-proxy-0")
+		})
+		g := NewGuard(client, record.NewFakeRecorder(10), 5)
+		lb := newLoadBalancer(nil)
+
+		if err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 10},
+		}); err != nil {
+			t.Fatalf("CheckAndEvict() error = %v, want nil for a pod that's already gone", err)
+		}
+	})
+
+	t.Run("an eviction error does not stop remaining pods from being checked", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		client.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "eviction" {
+				return false, nil, nil
+			}
+			obj := action.(clienttesting.CreateAction).GetObject()
+			if name := obj.(interface{ GetName() string }).GetName(); name == "lb-test-proxy-0" {
+				return true, nil, fmt.Errorf("boom")
+			}
+			return true, nil, nil
+		})
+		g := NewGuard(client, record.NewFakeRecorder(10), 5)
+		lb := newLoadBalancer(nil)
+
+		err := g.CheckAndEvict(lb, "kube-system", []lbapi.PodStatus{
+			{Name: "lb-test-proxy-0", RestartCount: 10},
+			{Name: "lb-test-proxy-1", RestartCount: 10},
+		})
+		if err == nil {
+			t.Fatalf("CheckAndEvict() error = nil, want the first eviction's error")
+		}
+
+		evictedSecond := false
+		for _, action := range client.Actions() {
+			if action.Matches("create", "pods") && action.GetSubresource() == "eviction" {
+				if action.(clienttesting.CreateAction).GetObject().(interface{ GetName() string }).GetName() == "lb-test-proxy-1" {
+					evictedSecond = true
+				}
+			}
+		}
+		if !evictedSecond {
+			t.Fatalf("expected proxy-1 to still be evicted despite proxy-0's error")
+		}
+	})
+}
@@ -17,14 +17,18 @@ limitations under the License.
 package lb
 
 import (
+	cryptorand "crypto/rand"
 	"fmt"
-	"math/rand"
-	"reflect"
+	"math/big"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
 
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/pkg/api/v1"
 )
@@ -72,57 +76,67 @@ func SplitNamespaceAndNameByDot(value string) (namespace, name string, err error
 	return parts[0], parts[1], nil
 }
 
-// ProxyStatusEqual check whether the given two PorxyStatuses are equal
-func ProxyStatusEqual(a, b lbapi.ProxyStatus) bool {
-
-	if !PodStatusesEqual(a.PodStatuses, b.PodStatuses) {
-		return false
+// sortedPodStatuses returns a copy of in, sorted by pod name, without
+// mutating in's backing array.
+func sortedPodStatuses(in []lbapi.PodStatus) []lbapi.PodStatus {
+	if len(in) == 0 {
+		return in
 	}
-	a.PodStatuses = lbapi.PodStatuses{}
-	b.PodStatuses = lbapi.PodStatuses{}
-	return reflect.DeepEqual(a, b)
+	out := make([]lbapi.PodStatus, len(in))
+	copy(out, in)
+	sort.Sort(SortPodStatusByName(out))
+	return out
 }
 
-// IpvsdrProviderStatusEqual check whether the given two Statuses are equal
-func IpvsdrProviderStatusEqual(a, b lbapi.IpvsdrProviderStatus) bool {
-	if !PodStatusesEqual(a.PodStatuses, b.PodStatuses) {
-		return false
+// sortPodStatuses replaces v's embedded PodStatuses.Statuses with a sorted
+// copy, if v is a pointer to a status type that embeds one; no-op otherwise.
+func sortPodStatuses(v interface{}) {
+	switch s := v.(type) {
+	case *lbapi.ProxyStatus:
+		s.PodStatuses.Statuses = sortedPodStatuses(s.PodStatuses.Statuses)
+	case *lbapi.IpvsdrProviderStatus:
+		s.PodStatuses.Statuses = sortedPodStatuses(s.PodStatuses.Statuses)
+	case *lbapi.PodStatuses:
+		s.Statuses = sortedPodStatuses(s.Statuses)
 	}
-	a.PodStatuses = lbapi.PodStatuses{}
-	b.PodStatuses = lbapi.PodStatuses{}
-	return reflect.DeepEqual(a, b)
 }
 
-// PodStatusesEqual check whether the given two PodStatuses are equal
-func PodStatusesEqual(a, b lbapi.PodStatuses) bool {
-	aStatus := a.Statuses
-	bStatus := b.Statuses
-
-	if len(aStatus) != len(bStatus) {
-		return false
-	}
+// StatusEqual reports whether a and b are equal, comparing any embedded
+// PodStatuses.Statuses via a sorted copy and using equality.Semantic so
+// nil and empty slices compare equal.
+func StatusEqual[T any](a, b T) bool {
+	sortPodStatuses(&a)
+	sortPodStatuses(&b)
+	return equality.Semantic.DeepEqual(a, b)
+}
 
-	a.Statuses = nil
-	b.Statuses = nil
+// StatusDiff returns a human-readable diff between a and b, suitable for a
+// controller Event message.
+func StatusDiff[T any](a, b T) string {
+	sortPodStatuses(&a)
+	sortPodStatuses(&b)
+	return diff.ObjectDiff(a, b)
+}
 
-	if !reflect.DeepEqual(a, b) {
-		return false
-	}
+// ProxyStatusEqual check whether the given two PorxyStatuses are equal
+//
+// Deprecated: use StatusEqual instead.
+func ProxyStatusEqual(a, b lbapi.ProxyStatus) bool {
+	return StatusEqual(a, b)
+}
 
-	for _, as := range aStatus {
-		equal := false
-		for _, bs := range bStatus {
-			if as.Name == bs.Name {
-				equal = reflect.DeepEqual(as, bs)
-				break
-			}
-		}
-		if !equal {
-			return false
-		}
-	}
+// IpvsdrProviderStatusEqual check whether the given two Statuses are equal
+//
+// Deprecated: use StatusEqual instead.
+func IpvsdrProviderStatusEqual(a, b lbapi.IpvsdrProviderStatus) bool {
+	return StatusEqual(a, b)
+}
 
-	return true
+// PodStatusesEqual check whether the given two PodStatuses are equal
+//
+// Deprecated: use StatusEqual instead.
+func PodStatusesEqual(a, b lbapi.PodStatuses) bool {
+	return StatusEqual(a, b)
 }
 
 // CalculateReplicas helps you to calculate replicas of lb
@@ -144,18 +158,76 @@ func CalculateReplicas(lb *lbapi.LoadBalancer) (int32, bool) {
 	return replicas, needNodeAffinity
 }
 
-// RandStringBytesRmndr returns a randome string.
-func RandStringBytesRmndr(n int) string {
-	rand.Seed(int64(time.Now().Nanosecond()))
-	var letterBytes = "abcdefghijklmnopqrstuvwxyz1234567890"
+// nameAlphabet is the lowercase alphanumeric charset used by NameSuffix.
+const nameAlphabet = "abcdefghijklmnopqrstuvwxyz1234567890"
+
+// dns1123NamePattern matches a valid Kubernetes object name: lowercase
+// alphanumerics and '-', starting with an alpha character and ending with an
+// alphanumeric one.
+var dns1123NamePattern = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+
+// NameSuffix returns a random lowercase alphanumeric string of length n,
+// drawn from crypto/rand via rejection sampling (no modulo bias).
+func NameSuffix(n int) string {
 	b := make([]byte, n)
-	b[0] = letterBytes[rand.Int63()%26]
-	for i := 1; i < n; i++ {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+	max := big.NewInt(int64(len(nameAlphabet)))
+	for i := range b {
+		idx, err := cryptorand.Int(cryptorand.Reader, max)
+		if err != nil {
+			// crypto/rand failing means the OS entropy source is broken;
+			// there's nothing sane to fall back to.
+			panic(fmt.Sprintf("lb: reading random bytes: %v", err))
+		}
+		b[i] = nameAlphabet[idx.Int64()]
 	}
 	return string(b)
 }
 
+// MustUniqueName returns prefix suffixed with n random characters from
+// NameSuffix, and panics if the result is not a valid DNS-1123 label.
+func MustUniqueName(prefix string, n int) string {
+	name := prefix + NameSuffix(n)
+	if len(name) > 63 || !dns1123NamePattern.MatchString(name) {
+		panic(fmt.Sprintf("lb: %q is not a valid DNS-1123 name", name))
+	}
+	return name
+}
+
+// RandStringBytesRmndr returns a random string whose first character is a
+// letter, same as the original math/rand implementation.
+//
+// Deprecated: use NameSuffix or MustUniqueName instead.
+func RandStringBytesRmndr(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	idx, err := cryptorand.Int(cryptorand.Reader, big.NewInt(26))
+	if err != nil {
+		panic(fmt.Sprintf("lb: reading random bytes: %v", err))
+	}
+	return string(nameAlphabet[idx.Int64()]) + NameSuffix(n-1)
+}
+
+// RestartableInitContainersAnnotation lists the comma-separated names of a
+// pod's sidecar (RestartPolicy: Always) init containers. The vendored
+// client-go API predates that field, so this annotation stands in for it.
+const RestartableInitContainersAnnotation = "loadbalance.caicloud.io/restartable-init-containers"
+
+// isRestartableInitContainer reports whether name is one of pod's sidecar
+// init containers, per RestartableInitContainersAnnotation.
+func isRestartableInitContainer(pod *v1.Pod, name string) bool {
+	ann := pod.Annotations[RestartableInitContainersAnnotation]
+	if ann == "" {
+		return false
+	}
+	for _, n := range strings.Split(ann, ",") {
+		if strings.TrimSpace(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
 // ComputePodStatus computes the pod's current status
 func ComputePodStatus(pod *v1.Pod) lbapi.PodStatus {
 	restarts := 0
@@ -167,28 +239,77 @@ func ComputePodStatus(pod *v1.Pod) lbapi.PodStatus {
 		reason = pod.Status.Reason
 	}
 
-	for i := len(pod.Status.ContainerStatuses) - 1; i >= 0; i-- {
-		container := pod.Status.ContainerStatuses[i]
+	// Sidecar-style init containers run for the life of the pod, so they're
+	// counted like regular containers regardless of where a still-pending,
+	// non-restartable init container sits relative to them in the list.
+	// Fold them in first and unconditionally, before the order-dependent
+	// pass below that can break out early.
+	for _, container := range pod.Status.InitContainerStatuses {
+		if !isRestartableInitContainer(pod, container.Name) {
+			continue
+		}
 		restarts += int(container.RestartCount)
+		totalContainers++
+		if container.Ready {
+			readyContainers++
+		}
+	}
 
-		if container.State.Waiting != nil && container.State.Waiting.Reason != "" {
-			reason = container.State.Waiting.Reason
-		} else if container.State.Terminated != nil && container.State.Terminated.Reason != "" {
-			reason = container.State.Terminated.Reason
-		} else if container.State.Terminated != nil && container.State.Terminated.Reason == "" {
-			if container.State.Terminated.Signal != 0 {
-				reason = fmt.Sprintf("Signal:%d", container.State.Terminated.Signal)
+	// Walk the init containers in order to determine whether the pod is
+	// still initializing: while it is, the regular containers haven't
+	// started yet and must not be counted towards readiness.
+	initializing := false
+	for i, container := range pod.Status.InitContainerStatuses {
+		if isRestartableInitContainer(pod, container.Name) && container.Ready {
+			continue
+		}
+		switch {
+		case container.State.Terminated != nil && container.State.Terminated.ExitCode == 0:
+			// init container ran to completion, move on to the next one
+			continue
+		case container.State.Terminated != nil:
+			if container.State.Terminated.Reason != "" {
+				reason = "Init:" + container.State.Terminated.Reason
+			} else if container.State.Terminated.Signal != 0 {
+				reason = fmt.Sprintf("Init:Signal:%d", container.State.Terminated.Signal)
 			} else {
-				reason = fmt.Sprintf("ExitCode:%d", container.State.Terminated.ExitCode)
+				reason = fmt.Sprintf("Init:ExitCode:%d", container.State.Terminated.ExitCode)
 			}
-		} else if container.Ready && container.State.Running != nil {
-			readyContainers++
+			initializing = true
+		case container.State.Waiting != nil && container.State.Waiting.Reason != "" && container.State.Waiting.Reason != "PodInitializing":
+			reason = "Init:" + container.State.Waiting.Reason
+			initializing = true
+		default:
+			reason = fmt.Sprintf("Init:%d/%d", i, len(pod.Spec.InitContainers))
+			initializing = true
 		}
-
+		break
 	}
 
-	if readyContainers == totalContainers {
-		ready = true
+	if !initializing {
+		for i := len(pod.Status.ContainerStatuses) - 1; i >= 0; i-- {
+			container := pod.Status.ContainerStatuses[i]
+			restarts += int(container.RestartCount)
+
+			if container.State.Waiting != nil && container.State.Waiting.Reason != "" {
+				reason = container.State.Waiting.Reason
+			} else if container.State.Terminated != nil && container.State.Terminated.Reason != "" {
+				reason = container.State.Terminated.Reason
+			} else if container.State.Terminated != nil && container.State.Terminated.Reason == "" {
+				if container.State.Terminated.Signal != 0 {
+					reason = fmt.Sprintf("Signal:%d", container.State.Terminated.Signal)
+				} else {
+					reason = fmt.Sprintf("ExitCode:%d", container.State.Terminated.ExitCode)
+				}
+			} else if container.Ready && container.State.Running != nil {
+				readyContainers++
+			}
+
+		}
+
+		if readyContainers == totalContainers {
+			ready = true
+		}
 	}
 
 	if pod.DeletionTimestamp != nil {
@@ -200,6 +321,19 @@ func ComputePodStatus(pod *v1.Pod) lbapi.PodStatus {
 		}
 	}
 
+	// TotalRestarts additionally folds in restarts accumulated by
+	// non-restartable init containers (retried by the kubelet while the pod
+	// is initializing), which restartguard can optionally factor into its
+	// eviction threshold.
+	totalRestarts := restarts
+	for _, container := range pod.Status.InitContainerStatuses {
+		if isRestartableInitContainer(pod, container.Name) {
+			// already folded into restarts, unconditionally, above
+			continue
+		}
+		totalRestarts += int(container.RestartCount)
+	}
+
 	status := lbapi.PodStatus{
 		Name:            pod.Name,
 		Ready:           ready,
@@ -207,6 +341,8 @@ func ComputePodStatus(pod *v1.Pod) lbapi.PodStatus {
 		ReadyContainers: int32(readyContainers),
 		TotalContainers: int32(totalContainers),
 		Reason:          reason,
+		RestartCount:    int32(restarts),
+		TotalRestarts:   int32(totalRestarts),
 	}
 	return status
-}
\ No newline at end of file
+}
@@ -0,0 +1,317 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lb
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// sidecarAnnotations marks names as sidecar init containers via
+// RestartableInitContainersAnnotation.
+func sidecarAnnotations(names ...string) map[string]string {
+	return map[string]string{RestartableInitContainersAnnotation: strings.Join(names, ",")}
+}
+
+func TestComputePodStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *v1.Pod
+		want lbapi.PodStatus
+	}{
+		{
+			name: "init container crash loop blocks the main containers",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "lb-proxy-0"},
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{Name: "init"}},
+					Containers:     []v1.Container{{Name: "nginx"}},
+					NodeName:       "node-1",
+				},
+				Status: v1.PodStatus{
+					InitContainerStatuses: []v1.ContainerStatus{
+						{
+							Name:         "init",
+							RestartCount: 3,
+							State: v1.ContainerState{
+								Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+							},
+						},
+					},
+					ContainerStatuses: []v1.ContainerStatus{
+						{Name: "nginx", Ready: false},
+					},
+				},
+			},
+			want: lbapi.PodStatus{
+				Name:            "lb-proxy-0",
+				Ready:           false,
+				NodeName:        "node-1",
+				ReadyContainers: 0,
+				TotalContainers: 1,
+				Reason:          "Init:CrashLoopBackOff",
+				RestartCount:    0,
+				TotalRestarts:   3,
+			},
+		},
+		{
+			name: "sidecar init container ready, main container still pending",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "lb-proxy-1", Annotations: sidecarAnnotations("sidecar")},
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{Name: "sidecar"}},
+					Containers:     []v1.Container{{Name: "nginx"}},
+					NodeName:       "node-1",
+				},
+				Status: v1.PodStatus{
+					Phase: v1.PodPending,
+					InitContainerStatuses: []v1.ContainerStatus{
+						{
+							Name:         "sidecar",
+							Ready:        true,
+							RestartCount: 1,
+							State:        v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+						},
+					},
+					ContainerStatuses: []v1.ContainerStatus{
+						{Name: "nginx", Ready: false},
+					},
+				},
+			},
+			want: lbapi.PodStatus{
+				Name:            "lb-proxy-1",
+				Ready:           false,
+				NodeName:        "node-1",
+				ReadyContainers: 1,
+				TotalContainers: 2,
+				Reason:          "Pending",
+				RestartCount:    1,
+				TotalRestarts:   1,
+			},
+		},
+		{
+			name: "init container with no sidecar annotation is treated as non-restartable",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "lb-proxy-stale"},
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{Name: "init"}},
+					Containers:     []v1.Container{{Name: "nginx"}},
+					NodeName:       "node-1",
+				},
+				Status: v1.PodStatus{
+					Phase: v1.PodRunning,
+					InitContainerStatuses: []v1.ContainerStatus{
+						{
+							Name:  "init",
+							Ready: true,
+							State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 0}},
+						},
+					},
+					ContainerStatuses: []v1.ContainerStatus{
+						{Name: "nginx", Ready: true, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+					},
+				},
+			},
+			want: lbapi.PodStatus{
+				Name:            "lb-proxy-stale",
+				Ready:           true,
+				NodeName:        "node-1",
+				ReadyContainers: 1,
+				TotalContainers: 1,
+				Reason:          "Running",
+				RestartCount:    0,
+				TotalRestarts:   0,
+			},
+		},
+		{
+			name: "terminating pod with a ready sidecar still reports Terminating",
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "lb-proxy-2",
+					DeletionTimestamp: &metav1.Time{Time: time.Unix(0, 0)},
+					Annotations:       sidecarAnnotations("sidecar"),
+				},
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{Name: "sidecar"}},
+					Containers:     []v1.Container{{Name: "nginx"}},
+					NodeName:       "node-1",
+				},
+				Status: v1.PodStatus{
+					Phase: v1.PodRunning,
+					InitContainerStatuses: []v1.ContainerStatus{
+						{
+							Name:  "sidecar",
+							Ready: true,
+							State: v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+						},
+					},
+					ContainerStatuses: []v1.ContainerStatus{
+						{Name: "nginx", Ready: true, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+					},
+				},
+			},
+			want: lbapi.PodStatus{
+				Name:            "lb-proxy-2",
+				Ready:           false,
+				NodeName:        "node-1",
+				ReadyContainers: 2,
+				TotalContainers: 2,
+				Reason:          "Terminating",
+				RestartCount:    0,
+				TotalRestarts:   0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ComputePodStatus(tt.pod)
+			if got != tt.want {
+				t.Errorf("ComputePodStatus() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b lbapi.PodStatuses
+		want bool
+	}{
+		{
+			name: "nil and empty slices are equal",
+			a:    lbapi.PodStatuses{Statuses: nil},
+			b:    lbapi.PodStatuses{Statuses: []lbapi.PodStatus{}},
+			want: true,
+		},
+		{
+			name: "out of order pod statuses are equal",
+			a: lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+				{Name: "a", Ready: true},
+				{Name: "b", Ready: false},
+			}},
+			b: lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+				{Name: "b", Ready: false},
+				{Name: "a", Ready: true},
+			}},
+			want: true,
+		},
+		{
+			name: "differing pod status is not equal",
+			a: lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+				{Name: "a", Ready: true},
+			}},
+			b: lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+				{Name: "a", Ready: false},
+			}},
+			want: false,
+		},
+		{
+			name: "differing length is not equal",
+			a: lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+				{Name: "a"},
+			}},
+			b:    lbapi.PodStatuses{Statuses: nil},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StatusEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("StatusEqual() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStatusEqualDoesNotMutateCaller guards against StatusEqual sorting a
+// caller's Statuses slice in place via the shared backing array that a
+// pass-by-value copy still points to.
+func TestStatusEqualDoesNotMutateCaller(t *testing.T) {
+	a := lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+		{Name: "b"},
+		{Name: "a"},
+	}}
+	b := lbapi.PodStatuses{Statuses: []lbapi.PodStatus{
+		{Name: "a"},
+		{Name: "b"},
+	}}
+
+	if !StatusEqual(a, b) {
+		t.Fatalf("StatusEqual() = false, want true")
+	}
+
+	if a.Statuses[0].Name != "b" || a.Statuses[1].Name != "a" {
+		t.Fatalf("StatusEqual mutated caller's slice order: got %+v", a.Statuses)
+	}
+}
+
+// TestNameSuffixConcurrentUnique guards against the math/rand-seeded
+// collisions that motivated replacing RandStringBytesRmndr: 1k goroutines
+// calling NameSuffix in the same instant must never observe the same
+// suffix.
+func TestNameSuffixConcurrentUnique(t *testing.T) {
+	const goroutines = 1000
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]struct{}, goroutines)
+	)
+
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			suffix := NameSuffix(8)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[suffix] = struct{}{}
+		}()
+	}
+	wg.Wait()
+
+	if len(results) != goroutines {
+		t.Fatalf("got %d unique suffixes out of %d goroutines, want %d (duplicates found)", len(results), goroutines, goroutines)
+	}
+}
+
+var dns1035LeadingLetter = regexp.MustCompile(`^[a-z]`)
+
+// TestRandStringBytesRmndrLeadingLetter verifies the deprecated wrapper
+// keeps the original implementation's guarantee that the result starts
+// with a letter, since callers have historically used it for RFC-1035
+// labels.
+func TestRandStringBytesRmndrLeadingLetter(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		got := RandStringBytesRmndr(6)
+		if !dns1035LeadingLetter.MatchString(got) {
+			t.Fatalf("RandStringBytesRmndr(6) = %q, want a leading letter", got)
+		}
+	}
+}